@@ -6,7 +6,9 @@
 package magnet
 
 import (
+	"encoding"
 	"encoding/base32"
+	"encoding/binary"
 	"encoding/hex"
 	"errors"
 	"net/url"
@@ -14,6 +16,11 @@ import (
 	"strings"
 )
 
+var (
+	_ encoding.TextMarshaler   = (*Magnet)(nil)
+	_ encoding.TextUnmarshaler = (*Magnet)(nil)
+)
+
 // Magnet hash type.
 type HashType int
 
@@ -27,6 +34,7 @@ const (
 	HashKazaa                    // Kazaa hash.
 	HashBTIH                     // BitTorrent Info Hash.
 	HashMD5                      // Message Digest 5.
+	HashBTMH                     // BitTorrent v2 multihash (BEP 52).
 )
 
 var HashTypeMap = map[string]HashType{
@@ -38,6 +46,7 @@ var HashTypeMap = map[string]HashType{
 	"kzhash":     HashKazaa,
 	"btih":       HashBTIH,
 	"md5":        HashMD5,
+	"btmh":       HashBTMH,
 }
 
 // Magnet key type
@@ -53,6 +62,7 @@ const (
 	KeyExactLength                     // Exact length in bytes.
 	KeyExactSource                     // p2p link.
 	KeyExactTopic                      // URN containing file hash.
+	KeySelectOnly                      // Select-only file indices/ranges (BEP 53).
 	KeySuplement                       // Suplemental keys (extensions).
 )
 
@@ -66,6 +76,7 @@ var KeyTypeMap = map[string]KeyType{
 	"xl": KeyExactLength,
 	"xs": KeyExactSource,
 	"xt": KeyExactTopic,
+	"so": KeySelectOnly,
 	"x.": KeySuplement,
 }
 
@@ -76,7 +87,32 @@ var (
 // Defines a Magnet hash.
 type Hash struct {
 	Type HashType // Hash type.
-	Data []byte   // Hash data.
+	Data []byte   // Hash data. For HashBTMH this is the raw, undecoded multihash.
+
+	// MultihashFunc and Digest are only populated for HashBTMH, where Data
+	// is a multihash: a varint hash-function code followed by a varint
+	// digest length followed by the digest itself.
+	MultihashFunc uint64 // Multihash hash-function code (e.g. 0x12 for sha2-256).
+	Digest        []byte // Decoded digest, e.g. the 32-byte v2 infohash for sha2-256.
+}
+
+// decodeMultihash parses a BEP 52 multihash: a varint hash-function code,
+// a varint digest length, then the digest bytes themselves.
+func decodeMultihash(b []byte) (code uint64, digest []byte, err error) {
+	code, n := binary.Uvarint(b)
+	if n <= 0 {
+		return 0, nil, ErrInvalidMagnet
+	}
+	b = b[n:]
+	length, n := binary.Uvarint(b)
+	if n <= 0 {
+		return 0, nil, ErrInvalidMagnet
+	}
+	b = b[n:]
+	if uint64(len(b)) != length {
+		return 0, nil, ErrInvalidMagnet
+	}
+	return code, b, nil
 }
 
 // Defines a Magnet URN.
@@ -108,13 +144,23 @@ func newURN(v string) (*URN, error) {
 		if err != nil {
 			return nil, err
 		}
-		r.Hashes = append(r.Hashes, Hash{ht, data})
+		r.Hashes = append(r.Hashes, Hash{Type: ht, Data: data})
 	case HashED2K, HashKazaa, HashBTIH:
 		data, err := hex.DecodeString(hd)
 		if err != nil {
 			return nil, err
 		}
-		r.Hashes = append(r.Hashes, Hash{ht, data})
+		r.Hashes = append(r.Hashes, Hash{Type: ht, Data: data})
+	case HashBTMH:
+		data, err := hex.DecodeString(hd)
+		if err != nil {
+			return nil, err
+		}
+		code, digest, err := decodeMultihash(data)
+		if err != nil {
+			return nil, err
+		}
+		r.Hashes = append(r.Hashes, Hash{Type: HashBTMH, Data: data, MultihashFunc: code, Digest: digest})
 	case HashBitPrint:
 		b := strings.Split(hd, ".")
 		if len(b) != 2 {
@@ -124,21 +170,105 @@ func newURN(v string) (*URN, error) {
 		if err != nil {
 			return nil, err
 		}
-		r.Hashes = append(r.Hashes, Hash{HashSHA1, data})
+		r.Hashes = append(r.Hashes, Hash{Type: HashSHA1, Data: data})
 		data, err = base32.StdEncoding.DecodeString(b[1])
 		if err != nil {
 			return nil, err
 		}
-		r.Hashes = append(r.Hashes, Hash{HashTTH, data})
+		r.Hashes = append(r.Hashes, Hash{Type: HashTTH, Data: data})
+	case HashType(-1):
+		return nil, ErrInvalidMagnet
 	}
 	return r, nil
 }
 
+// hashTypeURNName maps a HashType back to the URN namespace string it was
+// decoded from, the inverse of HashTypeMap.
+var hashTypeURNName = func() map[HashType]string {
+	m := make(map[HashType]string, len(HashTypeMap))
+	for name, ht := range HashTypeMap {
+		m[ht] = name
+	}
+	return m
+}()
+
+// encode renders h back into its "urn:<namespace>:<value>" form.
+func (h Hash) encode() (string, error) {
+	name, ok := hashTypeURNName[h.Type]
+	if !ok {
+		return "", ErrInvalidMagnet
+	}
+	switch h.Type {
+	case HashTTH, HashSHA1, HashAICH:
+		return "urn:" + name + ":" + base32.StdEncoding.EncodeToString(h.Data), nil
+	case HashED2K, HashKazaa, HashBTIH, HashMD5, HashBTMH:
+		return "urn:" + name + ":" + hex.EncodeToString(h.Data), nil
+	}
+	return "", ErrInvalidMagnet
+}
+
+// String renders u back into the "urn:..." form it was parsed from.
+func (u URN) String() (string, error) {
+	if len(u.Hashes) == 2 && u.Hashes[0].Type == HashSHA1 && u.Hashes[1].Type == HashTTH {
+		return "urn:bitprint:" +
+			base32.StdEncoding.EncodeToString(u.Hashes[0].Data) + "." +
+			base32.StdEncoding.EncodeToString(u.Hashes[1].Data), nil
+	}
+	if len(u.Hashes) != 1 {
+		return "", ErrInvalidMagnet
+	}
+	return u.Hashes[0].encode()
+}
+
 type Suplement struct {
 	Key string
 	Val string
 }
 
+// FileRange is a range of file indices in a multi-file torrent, as carried
+// by the "so" (select-only, BEP 53) key. A single index N decodes as
+// FileRange{N, N}.
+type FileRange struct {
+	First int
+	Last  int
+}
+
+// String renders f back into its "so" wire form: "N" if it's a single
+// index, "First-Last" otherwise.
+func (f FileRange) String() string {
+	if f.First == f.Last {
+		return strconv.Itoa(f.First)
+	}
+	return strconv.Itoa(f.First) + "-" + strconv.Itoa(f.Last)
+}
+
+// parseSelectOnly parses a "so" value: a comma-separated list of file
+// indices and "First-Last" ranges.
+func parseSelectOnly(v string) ([]FileRange, error) {
+	parts := strings.Split(v, ",")
+	r := make([]FileRange, 0, len(parts))
+	for _, p := range parts {
+		if i := strings.IndexByte(p, '-'); i >= 0 {
+			first, err := strconv.Atoi(p[:i])
+			if err != nil {
+				return nil, ErrInvalidMagnet
+			}
+			last, err := strconv.Atoi(p[i+1:])
+			if err != nil {
+				return nil, ErrInvalidMagnet
+			}
+			r = append(r, FileRange{First: first, Last: last})
+		} else {
+			n, err := strconv.Atoi(p)
+			if err != nil {
+				return nil, ErrInvalidMagnet
+			}
+			r = append(r, FileRange{First: n, Last: n})
+		}
+	}
+	return r, nil
+}
+
 type Magnet struct {
 	AcceptableSources []url.URL     // Fall-back sources, direct download from a web server.
 	DisplayNames      []string      // Filename/display name.
@@ -148,6 +278,8 @@ type Magnet struct {
 	ExactLength       int64         // Filesize. By logic only one key of thsi type should exist.
 	ExactSources      []string
 	ExactTopics       []URN
+	SelectOnly        []FileRange // Files to download, from "so" (BEP 53).
+	PeerAddresses     []string    // Peer "host:port" hints, from "x.pe".
 	Suplements        map[string][]Suplement
 }
 
@@ -171,20 +303,18 @@ func newMagnetKey(k string) (*magnetKey, error) {
 		return nil, ErrInvalidMagnet
 	}
 
-	// KeySuplement special case.
+	// KeySuplement special case: "x.pe" -> Supl "pe". There's no index to
+	// parse since whatever follows "x." is the suplement's own key.
 	if r.Type == KeySuplement {
-		b := strings.SplitAfterN(k, ".", 1)
-		if len(b) < 2 {
+		if len(k) <= 2 {
 			return nil, ErrInvalidMagnet
 		}
-		r.Supl = b[1]
+		r.Supl = k[2:]
+		return &r, nil
 	}
 
-	// Get index.
-	c := strings.Split(k, ".")
-	if len(c) > 2 {
-		return nil, ErrInvalidMagnet
-	}
+	// Get index, e.g. "xt.1" -> Indx 1.
+	c := strings.SplitN(k, ".", 2)
 	if len(c) == 2 {
 		v, err := strconv.Atoi(c[1])
 		if err != nil {
@@ -195,7 +325,8 @@ func newMagnetKey(k string) (*magnetKey, error) {
 	return &r, nil
 }
 
-// Parses key:value pairs, converts to go types and adds to self.
+// Parses a key:value pair, converts to go types and adds to self. "v" is
+// expected to already be query-unescaped, as done by Parser.Parse.
 func (m *Magnet) parseKeyVal(k, v string) error {
 	mk, err := newMagnetKey(k)
 	if err != nil {
@@ -209,17 +340,9 @@ func (m *Magnet) parseKeyVal(k, v string) error {
 		}
 		m.AcceptableSources = append(m.AcceptableSources, *u)
 	case KeyDisplayName:
-		u, err := url.QueryUnescape(v)
-		if err != nil {
-			return err
-		}
-		m.DisplayNames = append(m.DisplayNames, u)
+		m.DisplayNames = append(m.DisplayNames, v)
 	case KeyKeywordTopic:
-		u, err := url.QueryUnescape(v)
-		if err != nil {
-			return err
-		}
-		m.KeywordTopics = append(m.KeywordTopics, u)
+		m.KeywordTopics = append(m.KeywordTopics, v)
 	case KeyManifestTopic:
 		if strings.HasPrefix(strings.ToLower(v), "urn") {
 			u, err := newURN(v)
@@ -228,18 +351,10 @@ func (m *Magnet) parseKeyVal(k, v string) error {
 			}
 			m.ManifestTopics = append(m.ManifestTopics, u)
 		} else {
-			u, err := url.QueryUnescape(v)
-			if err != nil {
-				return err
-			}
-			m.ManifestTopics = append(m.ManifestTopics, u)
+			m.ManifestTopics = append(m.ManifestTopics, v)
 		}
 	case KeyTrackerAddress:
-		u, err := url.QueryUnescape(v)
-		if err != nil {
-			return err
-		}
-		m.TrackerAddresses = append(m.TrackerAddresses, u)
+		m.TrackerAddresses = append(m.TrackerAddresses, v)
 	case KeyExactLength:
 		u, err := strconv.ParseInt(v, 10, 64)
 		if err != nil {
@@ -253,45 +368,320 @@ func (m *Magnet) parseKeyVal(k, v string) error {
 		if err != nil {
 			return err
 		}
-		m.ManifestTopics = append(m.ManifestTopics, u)
+		m.ExactTopics = append(m.ExactTopics, *u)
+	case KeySelectOnly:
+		fr, err := parseSelectOnly(v)
+		if err != nil {
+			return err
+		}
+		m.SelectOnly = append(m.SelectOnly, fr...)
 	case KeySuplement:
+		// "x.pe" (peer address hints) gets a first-class field; other
+		// "x.*" extensions fall through to the generic Suplements map.
+		if mk.Supl == "pe" {
+			m.PeerAddresses = append(m.PeerAddresses, v)
+			break
+		}
+		if m.Suplements == nil {
+			m.Suplements = make(map[string][]Suplement)
+		}
 		m.Suplements[k[0:2]] = append(m.Suplements[k[0:2]], Suplement{mk.Supl, v})
 	}
 	return nil
 }
 
-// Does the main split then iterates over key:value pairs.
+// Parses the "magnet:?..." URI "s" via a Parser and adopts its result,
+// failing with ErrInvalidMagnet if any pair didn't parse, so the existing
+// strict behavior is preserved.
 func (m *Magnet) parseMagnet(s string) error {
-	a := strings.Split(s, ":?")
-	if len(a) != 2 {
-		goto error
+	res := (&Parser{}).Parse(s)
+	if len(res.Errors) > 0 {
+		return ErrInvalidMagnet
 	}
-	if strings.ToLower(a[0]) != "magnet" {
-		goto error
+	*m = *res.Magnet
+	return nil
+}
+
+// rawPair is one undecoded "key=value" pair from a magnet query string,
+// together with its byte offset within the original input.
+type rawPair struct {
+	key    string
+	val    string
+	offset int
+}
+
+// splitQuery splits a magnet's raw (still percent-encoded) query string
+// into rawPairs, recording each pair's byte offset relative to the start
+// of the original magnet string via queryOffset.
+func splitQuery(query string, queryOffset int) []rawPair {
+	var pairs []rawPair
+	offset := queryOffset
+	for _, part := range strings.Split(query, "&") {
+		if part != "" {
+			p := rawPair{offset: offset}
+			if i := strings.IndexByte(part, '='); i >= 0 {
+				p.key, p.val = part[:i], part[i+1:]
+			} else {
+				p.key = part
+			}
+			pairs = append(pairs, p)
+		}
+		offset += len(part) + 1 // +1 for the "&" that follows the part.
 	}
-	a = strings.Split(a[1], "&")
-	if len(a) == 0 {
-		goto error
+	return pairs
+}
+
+// splitMagnet splits a magnet string "s" into its raw query pairs, or
+// returns ok == false if "s" isn't a well-formed "magnet:?..." URI.
+//
+// This deliberately replaces the url.Parse/url.ParseQuery-based splitting
+// parseMagnet used before Parser existed: ParseError needs each pair's
+// byte offset in "s", which url.ParseQuery's map[string][]string result
+// discards. The percent-encoding and "=fpad"/nested-query correctness
+// url.ParseQuery bought us is kept by still running each raw key/value
+// through url.QueryUnescape below; only the splitting itself is redone.
+func splitMagnet(s string) (pairs []rawPair, ok bool) {
+	qi := strings.IndexByte(s, '?')
+	scheme := s
+	query := ""
+	queryOffset := len(s)
+	if qi >= 0 {
+		scheme = s[:qi]
+		query = s[qi+1:]
+		queryOffset = qi + 1
+	}
+	if !strings.EqualFold(strings.TrimSuffix(scheme, ":"), "magnet") {
+		return nil, false
+	}
+	return splitQuery(query, queryOffset), true
+}
+
+// Iterate walks the key:value pairs of the "magnet:?..." URI "s", calling
+// fn for each with its key and value already query-unescaped, without
+// allocating a Magnet. Useful for indexers that only want e.g. the "xt"
+// hash or "dn" display name out of a large batch of links. Iteration
+// stops and the error is returned as soon as fn (or unescaping) fails.
+func Iterate(s string, fn func(key, value string) error) error {
+	pairs, ok := splitMagnet(s)
+	if !ok {
+		return ErrInvalidMagnet
 	}
-	for _, v := range a {
-		b := strings.Split(v, "=")
-		if len(b) < 1 {
-			goto error
+	for _, p := range pairs {
+		key, err := url.QueryUnescape(p.key)
+		if err != nil {
+			return err
+		}
+		val, err := url.QueryUnescape(p.val)
+		if err != nil {
+			return err
 		}
-		if err := m.parseKeyVal(b[0], b[1]); err != nil {
+		if err := fn(key, val); err != nil {
 			return err
 		}
 	}
 	return nil
-error:
-	return ErrInvalidMagnet
 }
 
-// Creates a new *Magnet structure from a magnet string "s" or an error.
+// ParseError describes a single key:value pair that a Parser could not
+// make sense of.
+type ParseError struct {
+	Key    string // The offending key, e.g. "xt".
+	Value  string // The offending value.
+	Offset int    // Byte offset of the pair within the parsed input.
+	Err    error  // Underlying cause, e.g. an unknown hash type or bad base32.
+}
+
+func (e *ParseError) Error() string {
+	return "magnet: invalid \"" + e.Key + "=" + e.Value + "\" at offset " +
+		strconv.Itoa(e.Offset) + ": " + e.Err.Error()
+}
+
+func (e *ParseError) Unwrap() error { return e.Err }
+
+// ParseResult is the outcome of a Parser run: the Magnet assembled from
+// whatever key:value pairs parsed successfully, plus one ParseError per
+// pair that didn't.
+type ParseResult struct {
+	Magnet *Magnet
+	Errors []ParseError
+}
+
+// Parser parses magnet URIs leniently, collecting a ParseError for every
+// bad key:value pair instead of bailing out on the first one, so that
+// callers salvaging partial data from malformed links (crawlers, search
+// engines, upload validators) can still use whatever did parse.
+type Parser struct{}
+
+// Parse parses the "magnet:?..." URI "s" into a ParseResult. It never
+// returns a nil Magnet, even if every pair failed to parse.
+func (p *Parser) Parse(s string) *ParseResult {
+	res := &ParseResult{Magnet: &Magnet{}}
+	pairs, ok := splitMagnet(s)
+	if !ok {
+		res.Errors = append(res.Errors, ParseError{Offset: 0, Err: ErrInvalidMagnet})
+		return res
+	}
+	for _, p := range pairs {
+		key, err := url.QueryUnescape(p.key)
+		if err != nil {
+			res.Errors = append(res.Errors, ParseError{Key: p.key, Value: p.val, Offset: p.offset, Err: err})
+			continue
+		}
+		val, err := url.QueryUnescape(p.val)
+		if err != nil {
+			res.Errors = append(res.Errors, ParseError{Key: key, Value: p.val, Offset: p.offset, Err: err})
+			continue
+		}
+		if err := res.Magnet.parseKeyVal(key, val); err != nil {
+			res.Errors = append(res.Errors, ParseError{Key: key, Value: val, Offset: p.offset, Err: err})
+		}
+	}
+	return res
+}
+
+// Creates a new *Magnet structure from a magnet string "s" or an error. A
+// thin wrapper around Parser that preserves the strict, all-or-nothing
+// behavior of earlier versions: any bad key:value pair fails the whole
+// parse with ErrInvalidMagnet. Use Parser directly to salvage partial
+// results from malformed input instead.
 func NewMagnet(s string) (*Magnet, error) {
-	m := &Magnet{}
-	if err := m.parseMagnet(s); err != nil {
+	res := (&Parser{}).Parse(s)
+	if len(res.Errors) > 0 {
+		return nil, ErrInvalidMagnet
+	}
+	return res.Magnet, nil
+}
+
+// String re-serializes m into a canonical "magnet:?..." URI, percent
+// encoding values as needed and rendering hashes in their canonical
+// base32/hex form per hash type.
+func (m *Magnet) String() (string, error) {
+	q := url.Values{}
+	for _, as := range m.AcceptableSources {
+		q.Add("as", as.String())
+	}
+	for _, dn := range m.DisplayNames {
+		q.Add("dn", dn)
+	}
+	for _, kt := range m.KeywordTopics {
+		q.Add("kt", kt)
+	}
+	for _, mt := range m.ManifestTopics {
+		switch t := mt.(type) {
+		case *URN:
+			s, err := t.String()
+			if err != nil {
+				return "", err
+			}
+			q.Add("mt", s)
+		case string:
+			q.Add("mt", t)
+		default:
+			return "", ErrInvalidMagnet
+		}
+	}
+	for _, tr := range m.TrackerAddresses {
+		q.Add("tr", tr)
+	}
+	if m.ExactLength > 0 {
+		q.Add("xl", strconv.FormatInt(m.ExactLength, 10))
+	}
+	for _, xs := range m.ExactSources {
+		q.Add("xs", xs)
+	}
+	for _, urn := range m.ExactTopics {
+		s, err := urn.String()
+		if err != nil {
+			return "", err
+		}
+		q.Add("xt", s)
+	}
+	if len(m.SelectOnly) > 0 {
+		parts := make([]string, len(m.SelectOnly))
+		for i, fr := range m.SelectOnly {
+			parts[i] = fr.String()
+		}
+		q.Add("so", strings.Join(parts, ","))
+	}
+	for _, pe := range m.PeerAddresses {
+		q.Add("x.pe", pe)
+	}
+	for prefix, supls := range m.Suplements {
+		for _, s := range supls {
+			q.Add(prefix+s.Key, s.Val)
+		}
+	}
+	return "magnet:?" + q.Encode(), nil
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (m *Magnet) MarshalText() ([]byte, error) {
+	s, err := m.String()
+	if err != nil {
 		return nil, err
 	}
-	return m, nil
+	return []byte(s), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (m *Magnet) UnmarshalText(text []byte) error {
+	return m.parseMagnet(string(text))
+}
+
+// InfoHashV1 returns the BitTorrent v1 info hash (the 20-byte SHA-1 digest
+// of a "btih" URN) carried in m's ExactTopics, or nil if none is present.
+// A hybrid magnet carries both this and an InfoHashV2.
+func (m *Magnet) InfoHashV1() []byte {
+	for _, urn := range m.ExactTopics {
+		for _, h := range urn.Hashes {
+			if h.Type == HashBTIH {
+				return h.Data
+			}
+		}
+	}
+	return nil
+}
+
+// InfoHashV2 returns the BitTorrent v2 info hash (the 32-byte SHA-256
+// digest decoded from a "btmh" multihash, per BEP 52) carried in m's
+// ExactTopics, or nil if none is present.
+func (m *Magnet) InfoHashV2() []byte {
+	for _, urn := range m.ExactTopics {
+		for _, h := range urn.Hashes {
+			if h.Type == HashBTMH {
+				return h.Digest
+			}
+		}
+	}
+	return nil
+}
+
+// TorrentSpec holds the fields a downloader needs to start fetching a
+// torrent, as derived from a Magnet. It's the inverse of what the
+// magnet/metainfo package computes from a parsed .torrent file.
+type TorrentSpec struct {
+	InfoHashV1  []byte   // BitTorrent v1 infohash, or nil.
+	InfoHashV2  []byte   // BitTorrent v2 infohash (BEP 52), or nil.
+	Trackers    []string // Tracker addresses, from "tr".
+	DisplayName string   // First "dn", if any.
+	Length      int64    // Total size in bytes, from "xl".
+}
+
+// TorrentSpec extracts the fields needed to start fetching the torrent m
+// points at. It fails with ErrInvalidMagnet if m carries neither a v1 nor
+// a v2 infohash.
+func (m *Magnet) TorrentSpec() (*TorrentSpec, error) {
+	ts := &TorrentSpec{
+		InfoHashV1: m.InfoHashV1(),
+		InfoHashV2: m.InfoHashV2(),
+		Trackers:   m.TrackerAddresses,
+		Length:     m.ExactLength,
+	}
+	if ts.InfoHashV1 == nil && ts.InfoHashV2 == nil {
+		return nil, ErrInvalidMagnet
+	}
+	if len(m.DisplayNames) > 0 {
+		ts.DisplayName = m.DisplayNames[0]
+	}
+	return ts, nil
 }
@@ -6,6 +6,7 @@ package magnet
 
 import (
 	"fmt"
+	"strings"
 	"testing"
 )
 
@@ -32,3 +33,140 @@ func TestMain(t *testing.T) {
 	}
 	fmt.Printf("%+v\n", m)
 }
+
+func TestHybridMagnet(t *testing.T) {
+	s := "magnet:?xt=urn:btih:9480ac31b43e6219f2109c7877e48aeb47dfc7ac&xt=urn:btmh:1220d3fac6a6b6f0f86c7e38d3c6e4f2e8c3d93e5e24f2c1c3e0e9c9c9c9c9c9c9c9"
+	m, err := NewMagnet(s)
+	if err != nil {
+		t.Fatalf("NewMagnet() failed: %v\n", err)
+	}
+	if len(m.ExactTopics) != 2 {
+		t.Fatalf("expected 2 ExactTopics, got %d\n", len(m.ExactTopics))
+	}
+	if v1 := m.InfoHashV1(); len(v1) != 20 {
+		t.Errorf("InfoHashV1() returned %d bytes, want 20\n", len(v1))
+	}
+	v2 := m.InfoHashV2()
+	if len(v2) != 32 {
+		t.Errorf("InfoHashV2() returned %d bytes, want 32\n", len(v2))
+	}
+}
+
+func TestMagnetString(t *testing.T) {
+	s := "magnet:?xt=urn:btih:9480ac31b43e6219f2109c7877e48aeb47dfc7ac&dn=Of+Montreal"
+	m, err := NewMagnet(s)
+	if err != nil {
+		t.Fatalf("NewMagnet() failed: %v\n", err)
+	}
+	out, err := m.String()
+	if err != nil {
+		t.Fatalf("String() failed: %v\n", err)
+	}
+	m2, err := NewMagnet(out)
+	if err != nil {
+		t.Fatalf("NewMagnet() on round-tripped string failed: %v (%s)\n", err, out)
+	}
+	if len(m2.DisplayNames) != 1 || m2.DisplayNames[0] != "Of Montreal" {
+		t.Errorf("round-tripped DisplayNames = %v, want [Of Montreal]\n", m2.DisplayNames)
+	}
+	if v1 := m2.InfoHashV1(); len(v1) != 20 {
+		t.Errorf("round-tripped InfoHashV1() returned %d bytes, want 20\n", len(v1))
+	}
+}
+
+func TestSelectOnlyAndPeerAddresses(t *testing.T) {
+	s := "magnet:?xt=urn:btih:9480ac31b43e6219f2109c7877e48aeb47dfc7ac&so=0,2,4-6&x.pe=1.2.3.4:6881&x.foo=bar"
+	m, err := NewMagnet(s)
+	if err != nil {
+		t.Fatalf("NewMagnet() failed: %v\n", err)
+	}
+	want := []FileRange{{0, 0}, {2, 2}, {4, 6}}
+	if len(m.SelectOnly) != len(want) {
+		t.Fatalf("SelectOnly = %v, want %v\n", m.SelectOnly, want)
+	}
+	for i := range want {
+		if m.SelectOnly[i] != want[i] {
+			t.Errorf("SelectOnly[%d] = %v, want %v\n", i, m.SelectOnly[i], want[i])
+		}
+	}
+	if len(m.PeerAddresses) != 1 || m.PeerAddresses[0] != "1.2.3.4:6881" {
+		t.Errorf("PeerAddresses = %v, want [1.2.3.4:6881]\n", m.PeerAddresses)
+	}
+	if supl, ok := m.Suplements["x."]; !ok || len(supl) != 1 || supl[0].Key != "foo" || supl[0].Val != "bar" {
+		t.Errorf("Suplements[\"x.\"] = %v, want [{foo bar}]\n", supl)
+	}
+
+	out, err := m.String()
+	if err != nil {
+		t.Fatalf("String() failed: %v\n", err)
+	}
+	m2, err := NewMagnet(out)
+	if err != nil {
+		t.Fatalf("NewMagnet() on round-tripped string failed: %v (%s)\n", err, out)
+	}
+	if len(m2.SelectOnly) != len(want) || len(m2.PeerAddresses) != 1 {
+		t.Errorf("round-tripped SelectOnly/PeerAddresses mismatch: %v %v\n", m2.SelectOnly, m2.PeerAddresses)
+	}
+}
+
+func TestParserSalvagesPartialResults(t *testing.T) {
+	s := "magnet:?xt=urn:btih:9480ac31b43e6219f2109c7877e48aeb47dfc7ac&xl=notanumber&dn=Foo"
+	res := (&Parser{}).Parse(s)
+	if res.Magnet == nil {
+		t.Fatal("Parse() returned a nil Magnet")
+	}
+	if len(res.Magnet.ExactTopics) != 1 {
+		t.Errorf("ExactTopics = %v, want 1 entry\n", res.Magnet.ExactTopics)
+	}
+	if len(res.Magnet.DisplayNames) != 1 || res.Magnet.DisplayNames[0] != "Foo" {
+		t.Errorf("DisplayNames = %v, want [Foo]\n", res.Magnet.DisplayNames)
+	}
+	if len(res.Errors) != 1 {
+		t.Fatalf("Errors = %v, want 1 error\n", res.Errors)
+	}
+	if res.Errors[0].Key != "xl" || res.Errors[0].Value != "notanumber" {
+		t.Errorf("Errors[0] = %+v, want Key=xl Value=notanumber\n", res.Errors[0])
+	}
+	if res.Errors[0].Offset != strings.Index(s, "xl=notanumber") {
+		t.Errorf("Errors[0].Offset = %d, want %d\n", res.Errors[0].Offset, strings.Index(s, "xl=notanumber"))
+	}
+}
+
+func TestNewMagnetStillStrict(t *testing.T) {
+	s := "magnet:?xt=urn:btih:9480ac31b43e6219f2109c7877e48aeb47dfc7ac&xl=notanumber"
+	if _, err := NewMagnet(s); err != ErrInvalidMagnet {
+		t.Errorf("NewMagnet() error = %v, want ErrInvalidMagnet\n", err)
+	}
+}
+
+func TestIterate(t *testing.T) {
+	s := "magnet:?xt=urn:btih:9480ac31b43e6219f2109c7877e48aeb47dfc7ac&dn=Of+Montreal"
+	var got [][2]string
+	err := Iterate(s, func(key, value string) error {
+		got = append(got, [2]string{key, value})
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Iterate() failed: %v\n", err)
+	}
+	want := [][2]string{
+		{"xt", "urn:btih:9480ac31b43e6219f2109c7877e48aeb47dfc7ac"},
+		{"dn", "Of Montreal"},
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("Iterate() pairs = %v, want %v\n", got, want)
+	}
+}
+
+func TestMagnetValueWithEquals(t *testing.T) {
+	// A percent-encoded value containing "=" or "&" must come out of
+	// parsing intact, without being split at those characters.
+	s := "magnet:?xt=urn:sha1:YNCKHTQCWBTRNJIV4WNAE52SJUQCZO5C&dn=a%3Db%26c"
+	m, err := NewMagnet(s)
+	if err != nil {
+		t.Fatalf("NewMagnet() failed: %v\n", err)
+	}
+	if len(m.DisplayNames) != 1 || m.DisplayNames[0] != "a=b&c" {
+		t.Errorf("DisplayNames = %v, want [a=b&c]\n", m.DisplayNames)
+	}
+}
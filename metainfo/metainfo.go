@@ -0,0 +1,356 @@
+// Copyright 2013 Vedran Vuk. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package metainfo parses bencoded .torrent metainfo files and converts
+// between them and magnet links, without pulling in a full BitTorrent
+// client.
+package metainfo
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"net/url"
+	"strconv"
+
+	"github.com/vedranvuk/magnet"
+)
+
+// ErrInvalidTorrent is returned when a .torrent file is malformed.
+var ErrInvalidTorrent = errors.New("metainfo: invalid torrent")
+
+// File is one entry of a multi-file torrent's file list.
+type File struct {
+	Path   []string // Path segments, innermost last.
+	Length int64    // File size in bytes.
+}
+
+// Info is the decoded "info" dictionary of a .torrent file.
+type Info struct {
+	Name        string // Suggested display name/directory name.
+	PieceLength int64  // Piece size in bytes.
+	Pieces      []byte // Concatenated SHA-1 piece hashes.
+	Length      int64  // Single-file torrents only; 0 for multi-file.
+	Files       []File // Multi-file torrents only; empty for single-file.
+	MetaVersion int64  // BEP 52 "meta version"; 2 when v2 hashes apply.
+}
+
+// TotalLength returns the torrent's total content size, summing Files for
+// multi-file torrents.
+func (i *Info) TotalLength() int64 {
+	if len(i.Files) == 0 {
+		return i.Length
+	}
+	var total int64
+	for _, f := range i.Files {
+		total += f.Length
+	}
+	return total
+}
+
+// Torrent is the decoded contents of a .torrent metainfo file.
+type Torrent struct {
+	Announce     string     // Primary tracker, from "announce".
+	AnnounceList [][]string // Tracker tiers, from "announce-list" (BEP 12).
+	URLList      []string   // Webseeds, from "url-list" (BEP 19).
+	Info         Info       // The decoded "info" dictionary.
+	InfoBytes    []byte     // Raw bencoded "info" dict, needed to hash it.
+}
+
+// InfoHashV1 returns the SHA-1 of the raw info dict, the BitTorrent v1
+// infohash.
+func (t *Torrent) InfoHashV1() []byte {
+	h := sha1.Sum(t.InfoBytes)
+	return h[:]
+}
+
+// InfoHashV2 returns the SHA-256 of the raw info dict, the BitTorrent v2
+// infohash (BEP 52), or nil if t isn't a v2/hybrid torrent.
+func (t *Torrent) InfoHashV2() []byte {
+	if t.Info.MetaVersion != 2 {
+		return nil
+	}
+	h := sha256.Sum256(t.InfoBytes)
+	return h[:]
+}
+
+// sha2256Multicodec is the multihash function code for sha2-256, per the
+// multihash spec referenced by BEP 52 ("1220" hex prefix: code 0x12,
+// length 0x20).
+const sha2256Multicodec = 0x12
+
+// newSHA256Multihash renders digest as a BEP 52 multihash: a varint
+// hash-function code, a varint digest length, then the digest itself.
+func newSHA256Multihash(digest []byte) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	mh := make([]byte, 0, 2+len(digest))
+	n := binary.PutUvarint(buf[:], sha2256Multicodec)
+	mh = append(mh, buf[:n]...)
+	n = binary.PutUvarint(buf[:], uint64(len(digest)))
+	mh = append(mh, buf[:n]...)
+	mh = append(mh, digest...)
+	return mh
+}
+
+// Magnet derives a *magnet.Magnet from t: its v1/v2 infohashes, display
+// name, trackers, total size and webseeds.
+func (t *Torrent) Magnet() (*magnet.Magnet, error) {
+	m := &magnet.Magnet{
+		ExactTopics: []magnet.URN{
+			{Hashes: []magnet.Hash{{Type: magnet.HashBTIH, Data: t.InfoHashV1()}}},
+		},
+		ExactLength: t.Info.TotalLength(),
+	}
+	if v2 := t.InfoHashV2(); v2 != nil {
+		mh := newSHA256Multihash(v2)
+		m.ExactTopics = append(m.ExactTopics, magnet.URN{
+			Hashes: []magnet.Hash{{
+				Type:          magnet.HashBTMH,
+				Data:          mh,
+				MultihashFunc: sha2256Multicodec,
+				Digest:        v2,
+			}},
+		})
+	}
+	if t.Info.Name != "" {
+		m.DisplayNames = append(m.DisplayNames, t.Info.Name)
+	}
+	// BEP 12: when announce-list is present, it supersedes announce. Most
+	// torrents also repeat announce as announce-list's first entry, so
+	// appending both would list the primary tracker twice.
+	if len(t.AnnounceList) > 0 {
+		for _, tier := range t.AnnounceList {
+			m.TrackerAddresses = append(m.TrackerAddresses, tier...)
+		}
+	} else if t.Announce != "" {
+		m.TrackerAddresses = append(m.TrackerAddresses, t.Announce)
+	}
+	for _, s := range t.URLList {
+		u, err := url.Parse(s)
+		if err != nil {
+			return nil, err
+		}
+		m.AcceptableSources = append(m.AcceptableSources, *u)
+	}
+	return m, nil
+}
+
+// Parse decodes the bencoded .torrent metainfo file "data" into a Torrent.
+func Parse(data []byte) (*Torrent, error) {
+	d := &decoder{data: data}
+	if d.pos >= len(d.data) || d.data[d.pos] != 'd' {
+		return nil, ErrInvalidTorrent
+	}
+	spans := make(map[string][]byte)
+	raw, err := d.decodeDict(spans)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &Torrent{}
+	if v, ok := raw["announce"].([]byte); ok {
+		t.Announce = string(v)
+	}
+	if v, ok := raw["announce-list"].([]interface{}); ok {
+		for _, tierRaw := range v {
+			tierList, ok := tierRaw.([]interface{})
+			if !ok {
+				continue
+			}
+			var tier []string
+			for _, trRaw := range tierList {
+				if tr, ok := trRaw.([]byte); ok {
+					tier = append(tier, string(tr))
+				}
+			}
+			t.AnnounceList = append(t.AnnounceList, tier)
+		}
+	}
+	switch v := raw["url-list"].(type) {
+	case []byte:
+		t.URLList = append(t.URLList, string(v))
+	case []interface{}:
+		for _, e := range v {
+			if b, ok := e.([]byte); ok {
+				t.URLList = append(t.URLList, string(b))
+			}
+		}
+	}
+
+	infoRaw, ok := raw["info"].(map[string]interface{})
+	if !ok {
+		return nil, ErrInvalidTorrent
+	}
+	t.InfoBytes = spans["info"]
+	t.Info = decodeInfo(infoRaw)
+	return t, nil
+}
+
+// decodeInfo converts a decoded "info" dictionary into an Info.
+func decodeInfo(raw map[string]interface{}) Info {
+	var info Info
+	if v, ok := raw["name"].([]byte); ok {
+		info.Name = string(v)
+	}
+	if v, ok := raw["piece length"].(int64); ok {
+		info.PieceLength = v
+	}
+	if v, ok := raw["pieces"].([]byte); ok {
+		info.Pieces = v
+	}
+	if v, ok := raw["meta version"].(int64); ok {
+		info.MetaVersion = v
+	}
+	if v, ok := raw["length"].(int64); ok {
+		info.Length = v
+	}
+	if v, ok := raw["files"].([]interface{}); ok {
+		for _, fRaw := range v {
+			fd, ok := fRaw.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			var f File
+			if l, ok := fd["length"].(int64); ok {
+				f.Length = l
+			}
+			if p, ok := fd["path"].([]interface{}); ok {
+				for _, seg := range p {
+					if b, ok := seg.([]byte); ok {
+						f.Path = append(f.Path, string(b))
+					}
+				}
+			}
+			info.Files = append(info.Files, f)
+		}
+	}
+	return info
+}
+
+// decoder is a minimal bencode decoder, just enough of the format (BEP 3)
+// to walk a .torrent file: integers, byte strings, lists and dicts.
+type decoder struct {
+	data  []byte
+	pos   int
+	depth int
+}
+
+// maxDecodeDepth bounds how deeply nested lists and dicts may be, so that
+// a crafted .torrent with millions of nested "l"/"d" can't blow the stack
+// via unbounded recursion.
+const maxDecodeDepth = 500
+
+func (d *decoder) decode() (interface{}, error) {
+	if d.pos >= len(d.data) {
+		return nil, ErrInvalidTorrent
+	}
+	switch d.data[d.pos] {
+	case 'i':
+		return d.decodeInt()
+	case 'l':
+		return d.decodeList()
+	case 'd':
+		return d.decodeDict(nil)
+	default:
+		return d.decodeBytes()
+	}
+}
+
+func (d *decoder) decodeInt() (int64, error) {
+	d.pos++ // consume 'i'
+	start := d.pos
+	for d.pos < len(d.data) && d.data[d.pos] != 'e' {
+		d.pos++
+	}
+	if d.pos >= len(d.data) {
+		return 0, ErrInvalidTorrent
+	}
+	n, err := strconv.ParseInt(string(d.data[start:d.pos]), 10, 64)
+	if err != nil {
+		return 0, ErrInvalidTorrent
+	}
+	d.pos++ // consume 'e'
+	return n, nil
+}
+
+func (d *decoder) decodeBytes() ([]byte, error) {
+	start := d.pos
+	for d.pos < len(d.data) && d.data[d.pos] != ':' {
+		d.pos++
+	}
+	if d.pos >= len(d.data) {
+		return nil, ErrInvalidTorrent
+	}
+	n, err := strconv.Atoi(string(d.data[start:d.pos]))
+	if err != nil || n < 0 {
+		return nil, ErrInvalidTorrent
+	}
+	d.pos++ // consume ':'
+	// n can be an arbitrarily huge (but validly-parsed) int64; computing
+	// d.pos+n could overflow and wrap negative, defeating this bounds
+	// check, so compare against the remaining length instead of summing.
+	if n < 0 || n > len(d.data)-d.pos {
+		return nil, ErrInvalidTorrent
+	}
+	b := d.data[d.pos : d.pos+n]
+	d.pos += n
+	return b, nil
+}
+
+func (d *decoder) decodeList() ([]interface{}, error) {
+	d.depth++
+	defer func() { d.depth-- }()
+	if d.depth > maxDecodeDepth {
+		return nil, ErrInvalidTorrent
+	}
+	d.pos++ // consume 'l'
+	var list []interface{}
+	for d.pos < len(d.data) && d.data[d.pos] != 'e' {
+		v, err := d.decode()
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, v)
+	}
+	if d.pos >= len(d.data) {
+		return nil, ErrInvalidTorrent
+	}
+	d.pos++ // consume 'e'
+	return list, nil
+}
+
+// decodeDict decodes a dictionary. If spans is non-nil, it also records
+// the raw (still bencoded) byte span of each top-level value keyed by
+// name, so callers can recover e.g. the exact bytes of the "info" dict to
+// hash.
+func (d *decoder) decodeDict(spans map[string][]byte) (map[string]interface{}, error) {
+	d.depth++
+	defer func() { d.depth-- }()
+	if d.depth > maxDecodeDepth {
+		return nil, ErrInvalidTorrent
+	}
+	d.pos++ // consume 'd'
+	dict := make(map[string]interface{})
+	for d.pos < len(d.data) && d.data[d.pos] != 'e' {
+		k, err := d.decodeBytes()
+		if err != nil {
+			return nil, err
+		}
+		valStart := d.pos
+		v, err := d.decode()
+		if err != nil {
+			return nil, err
+		}
+		dict[string(k)] = v
+		if spans != nil {
+			spans[string(k)] = d.data[valStart:d.pos]
+		}
+	}
+	if d.pos >= len(d.data) {
+		return nil, ErrInvalidTorrent
+	}
+	d.pos++ // consume 'e'
+	return dict, nil
+}
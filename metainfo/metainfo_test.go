@@ -0,0 +1,160 @@
+// Copyright 2013 Vedran Vuk. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package metainfo
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+const testTorrent = "d8:announce20:http://tracker.test/4:infod6:lengthi12e4:name8:test.txt12:piece lengthi16384e6:pieces20:01234567890123456789ee"
+
+const testTorrentInfoHashV1 = "5c71a40bdb981dd4a35a9d9cad1f7f4079e7b225"
+
+func TestParseAndMagnet(t *testing.T) {
+	tr, err := Parse([]byte(testTorrent))
+	if err != nil {
+		t.Fatalf("Parse() failed: %v\n", err)
+	}
+	if tr.Announce != "http://tracker.test/" {
+		t.Errorf("Announce = %q, want %q\n", tr.Announce, "http://tracker.test/")
+	}
+	if tr.Info.Name != "test.txt" {
+		t.Errorf("Info.Name = %q, want %q\n", tr.Info.Name, "test.txt")
+	}
+	if tr.Info.TotalLength() != 12 {
+		t.Errorf("Info.TotalLength() = %d, want 12\n", tr.Info.TotalLength())
+	}
+
+	m, err := tr.Magnet()
+	if err != nil {
+		t.Fatalf("Magnet() failed: %v\n", err)
+	}
+	if got := hex.EncodeToString(m.InfoHashV1()); got != testTorrentInfoHashV1 {
+		t.Errorf("InfoHashV1() = %s, want %s\n", got, testTorrentInfoHashV1)
+	}
+	if len(m.DisplayNames) != 1 || m.DisplayNames[0] != "test.txt" {
+		t.Errorf("DisplayNames = %v, want [test.txt]\n", m.DisplayNames)
+	}
+	if len(m.TrackerAddresses) != 1 || m.TrackerAddresses[0] != "http://tracker.test/" {
+		t.Errorf("TrackerAddresses = %v, want [http://tracker.test/]\n", m.TrackerAddresses)
+	}
+	if m.ExactLength != 12 {
+		t.Errorf("ExactLength = %d, want 12\n", m.ExactLength)
+	}
+
+	s, err := m.String()
+	if err != nil {
+		t.Fatalf("String() failed: %v\n", err)
+	}
+	spec, err := m.TorrentSpec()
+	if err != nil {
+		t.Fatalf("TorrentSpec() failed: %v (%s)\n", err, s)
+	}
+	if spec.DisplayName != "test.txt" || spec.Length != 12 {
+		t.Errorf("TorrentSpec() = %+v, want DisplayName=test.txt Length=12\n", spec)
+	}
+}
+
+// testHybridTorrent is a multi-file, meta-version=2 torrent whose
+// announce-list first tier repeats its announce, url-list carries two
+// webseeds, and whose "info" dict hashes to testHybridInfoHashV1/V2 below.
+const testHybridTorrent = "d8:announce19:http://tracker.one/13:announce-listll19:http://tracker.one/el19:http://tracker.two/ee4:infod5:filesld6:lengthi5e4:pathl5:a.txteed6:lengthi7e4:pathl3:dir5:b.txteee12:meta versioni2e4:name4:root12:piece lengthi16384e6:pieces20:01234567890123456789e8:url-listl16:http://seed.one/24:http://seed.two/file.raree"
+
+const testHybridInfoHashV1 = "4cf764145c77f0b433364322fac3f17a0d1966c5"
+const testHybridInfoHashV2 = "b84e946cf665f6e7a7a263b2f55f933248a21cca755a58b31dd4a1d88e8158dc"
+
+func TestMultiFileHybridTorrent(t *testing.T) {
+	tr, err := Parse([]byte(testHybridTorrent))
+	if err != nil {
+		t.Fatalf("Parse() failed: %v\n", err)
+	}
+
+	// Multi-file Files/TotalLength summation.
+	if len(tr.Info.Files) != 2 {
+		t.Fatalf("Info.Files = %v, want 2 entries\n", tr.Info.Files)
+	}
+	if got, want := tr.Info.Files[0].Path, []string{"a.txt"}; len(got) != 1 || got[0] != want[0] {
+		t.Errorf("Info.Files[0].Path = %v, want %v\n", got, want)
+	}
+	if got, want := tr.Info.Files[1].Path, []string{"dir", "b.txt"}; len(got) != 2 || got[0] != want[0] || got[1] != want[1] {
+		t.Errorf("Info.Files[1].Path = %v, want %v\n", got, want)
+	}
+	if tr.Info.TotalLength() != 12 {
+		t.Errorf("Info.TotalLength() = %d, want 12 (5+7)\n", tr.Info.TotalLength())
+	}
+
+	// announce-list tiers.
+	if len(tr.AnnounceList) != 2 || len(tr.AnnounceList[0]) != 1 || len(tr.AnnounceList[1]) != 1 {
+		t.Fatalf("AnnounceList = %v, want 2 tiers of 1\n", tr.AnnounceList)
+	}
+
+	// url-list webseeds.
+	if len(tr.URLList) != 2 {
+		t.Fatalf("URLList = %v, want 2 entries\n", tr.URLList)
+	}
+
+	// meta-version=2 -> InfoHashV2.
+	if tr.Info.MetaVersion != 2 {
+		t.Errorf("Info.MetaVersion = %d, want 2\n", tr.Info.MetaVersion)
+	}
+	if got := hex.EncodeToString(tr.InfoHashV1()); got != testHybridInfoHashV1 {
+		t.Errorf("Torrent.InfoHashV1() = %s, want %s\n", got, testHybridInfoHashV1)
+	}
+	if got := hex.EncodeToString(tr.InfoHashV2()); got != testHybridInfoHashV2 {
+		t.Errorf("Torrent.InfoHashV2() = %s, want %s\n", got, testHybridInfoHashV2)
+	}
+
+	m, err := tr.Magnet()
+	if err != nil {
+		t.Fatalf("Magnet() failed: %v\n", err)
+	}
+
+	// announce-list supersedes announce (BEP 12): no duplicate primary
+	// tracker even though announce-list's first tier repeats announce.
+	if len(m.TrackerAddresses) != 2 {
+		t.Fatalf("TrackerAddresses = %v, want 2 entries (no duplicate of announce)\n", m.TrackerAddresses)
+	}
+
+	// url-list -> AcceptableSources.
+	if len(m.AcceptableSources) != 2 {
+		t.Fatalf("AcceptableSources = %v, want 2 entries\n", m.AcceptableSources)
+	}
+	if got := m.AcceptableSources[1].String(); got != "http://seed.two/file.rar" {
+		t.Errorf("AcceptableSources[1] = %s, want http://seed.two/file.rar\n", got)
+	}
+
+	// The derived Magnet carries both infohashes: v1 as btih, v2 as btmh.
+	if got := hex.EncodeToString(m.InfoHashV1()); got != testHybridInfoHashV1 {
+		t.Errorf("Magnet.InfoHashV1() = %s, want %s\n", got, testHybridInfoHashV1)
+	}
+	if got := hex.EncodeToString(m.InfoHashV2()); got != testHybridInfoHashV2 {
+		t.Errorf("Magnet.InfoHashV2() = %s, want %s\n", got, testHybridInfoHashV2)
+	}
+}
+
+func TestParseRejectsExcessiveNesting(t *testing.T) {
+	const depth = 10000
+	var b strings.Builder
+	b.WriteString("d1:a")
+	for i := 0; i < depth; i++ {
+		b.WriteByte('l')
+	}
+	for i := 0; i < depth; i++ {
+		b.WriteByte('e')
+	}
+	b.WriteString("e")
+	if _, err := Parse([]byte(b.String())); err != ErrInvalidTorrent {
+		t.Errorf("Parse() error = %v, want ErrInvalidTorrent\n", err)
+	}
+}
+
+func TestParseRejectsOverflowingByteStringLength(t *testing.T) {
+	s := "d4:info" + "9223372036854775807:x"
+	if _, err := Parse([]byte(s)); err != ErrInvalidTorrent {
+		t.Errorf("Parse() error = %v, want ErrInvalidTorrent\n", err)
+	}
+}